@@ -0,0 +1,132 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package messageQueue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fission/fission/crd"
+)
+
+const (
+	// MessageQueueTypeNats is the MQType value that selects the NATS JetStream driver. The
+	// value is kept as "nats-streaming" for backward compatibility with existing
+	// MessageQueueConfig CRDs, even though the driver itself no longer uses nats-streaming.
+	MessageQueueTypeNats = "nats-streaming"
+
+	// MessageQueueTypeRabbitMQ is the MQType value that selects the RabbitMQ driver.
+	MessageQueueTypeRabbitMQ = "rabbitmq"
+)
+
+// ConnectionState describes the health of a MessageQueue's connection to its broker, as
+// returned by MessageQueue.Health().
+type ConnectionState int
+
+const (
+	ConnectionConnected ConnectionState = iota
+	ConnectionDisconnected
+	ConnectionReconnecting
+	ConnectionClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionDisconnected:
+		return "disconnected"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	case ConnectionClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type (
+	// MessageQueueConfig is the configuration needed to connect to a message queue broker.
+	// Drivers ignore the fields they don't need.
+	MessageQueueConfig struct {
+		MQType string
+		Url    string
+
+		// ExchangeType is the AMQP exchange type ("direct", "topic" or "fanout") used by
+		// brokers that are exchange based, such as RabbitMQ. Ignored by other drivers.
+		ExchangeType string
+
+		// PrefetchCount bounds how many unacked messages a driver may have in flight at once.
+		PrefetchCount int
+
+		// Secrets is the path to a directory containing TLS material (cacert.pem, cert.pem,
+		// key.pem) used to connect to the broker over TLS. Empty means no TLS.
+		Secrets string
+
+		// MaxReconnects bounds how many times a driver retries a dropped connection before
+		// giving up. Zero means use the driver's default; negative means retry forever.
+		MaxReconnects int
+
+		// ReconnectWait is the base delay between reconnect attempts. Drivers that back off
+		// exponentially treat this as the starting delay.
+		ReconnectWait time.Duration
+	}
+
+	// messageQueueSubscription is an opaque handle returned by MessageQueue.subscribe. Each
+	// driver defines its own concrete type and type-asserts it back in unsubscribe.
+	messageQueueSubscription interface{}
+
+	// MessageQueue is implemented by every message queue driver (Nats, RabbitMQ, ...). The
+	// mqtrigger controller only ever talks to this interface, so adding a new broker is a
+	// matter of registering a new driver, not changing the controller.
+	MessageQueue interface {
+		subscribe(trigger *crd.MessageQueueTrigger) (messageQueueSubscription, error)
+		unsubscribe(subscription messageQueueSubscription) error
+
+		// Health reports the current state of the driver's connection to its broker, so the
+		// controller can surface broker outages instead of triggers silently going quiet.
+		Health() ConnectionState
+	}
+
+	// messageQueueFactory builds a MessageQueue from the router URL (where function HTTP
+	// requests are sent) and the broker config from the MessageQueueConfig CRD/flag.
+	messageQueueFactory func(routerUrl string, mqCfg MessageQueueConfig) (MessageQueue, error)
+)
+
+// messageQueueFactories is the driver registry, keyed by the lower-cased MQType. Drivers
+// register themselves from an init() in their own file.
+var messageQueueFactories = make(map[string]messageQueueFactory)
+
+// registerMessageQueue adds a driver to the registry. It panics on a duplicate MQType since
+// that can only happen from a programming error (two drivers registering the same type).
+func registerMessageQueue(mqType string, factory messageQueueFactory) {
+	mqType = strings.ToLower(mqType)
+	if _, ok := messageQueueFactories[mqType]; ok {
+		panic(fmt.Sprintf("message queue type %q registered twice", mqType))
+	}
+	messageQueueFactories[mqType] = factory
+}
+
+// New looks up the driver for mqCfg.MQType and constructs a MessageQueue from it.
+func New(routerUrl string, mqCfg MessageQueueConfig) (MessageQueue, error) {
+	factory, ok := messageQueueFactories[strings.ToLower(mqCfg.MQType)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported message queue type: %q", mqCfg.MQType)
+	}
+	return factory(routerUrl, mqCfg)
+}
@@ -17,15 +17,13 @@ limitations under the License.
 package messageQueue
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	ns "github.com/nats-io/go-nats-streaming"
-	nsUtil "github.com/nats-io/nats-streaming-server/util"
+	"github.com/nats-io/nats.go"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/fission/fission"
@@ -33,66 +31,364 @@ import (
 )
 
 const (
-	natsClusterID  = "fissionMQTrigger"
 	natsProtocol   = "nats://"
 	natsClientID   = "fission"
 	natsQueueGroup = "fission-messageQueueNatsTrigger"
+
+	// natsDefaultStreamName is used when a trigger doesn't set Spec.Stream.
+	natsDefaultStreamName = "fission"
+
+	// natsPullBatchSize and natsPullWait tune how the consumer loop pulls from JetStream:
+	// fetch up to natsPullBatchSize messages, waiting at most natsPullWait for the first one.
+	natsPullBatchSize = 10
+	natsPullWait      = 5 * time.Second
+
+	// TriggerTypeRequest marks a MessageQueueTrigger as request/reply rather than
+	// fire-and-forget: the function's response is published back on the request's reply
+	// subject instead of (or in addition to) ResponseTopic.
+	TriggerTypeRequest = "request"
+
+	// natsReplyHeader is the JetStream-side equivalent of a core NATS message's Reply field:
+	// since a pulled message has no reply subject of its own, a publisher that wants a
+	// synchronous reply over JetStream sets this header to its inbox subject instead.
+	natsReplyHeader = "Nats-Reply"
+
+	// natsStatusCodeHeader carries the function's HTTP status code back to the requester on
+	// the reply subject, since a raw NATS reply has no place for one otherwise.
+	natsStatusCodeHeader = "X-Fission-MQTrigger-StatusCode"
+
+	// natsDefaultReconnectWait is the base reconnect delay used when MessageQueueConfig
+	// doesn't set one.
+	natsDefaultReconnectWait = time.Second
+
+	// natsMaxReconnectWait caps the exponential reconnect backoff.
+	natsMaxReconnectWait = 30 * time.Second
 )
 
 type (
+	// Nats talks to a JetStream-enabled nats-server. Each subscribe() call ensures the
+	// trigger's stream exists and binds a durable pull consumer to it; a goroutine per
+	// trigger repeatedly fetches and hands messages to msgHandler. TriggerTypeRequest
+	// triggers are the exception: they get a core NATS queue subscription (see
+	// subscribeRequest) and no stream or consumer. Nats also owns the
+	// reconnect supervision for the underlying connection: subs tracks every active
+	// JetStream subscription so resubscribeAll can rebind them after a reconnect.
 	Nats struct {
-		nsConn    ns.Conn
+		nsConn    *nats.Conn
 		routerUrl string
+
+		mu sync.RWMutex
+		js nats.JetStreamContext
+		// subs is keyed by trigger UID; only JetStream pull subscriptions are tracked here,
+		// since core NATS subscriptions (used by TriggerTypeRequest) are resubscribed by the
+		// nats.go client itself on reconnect.
+		subs map[string]*natsSubscription
+	}
+
+	natsSubscription struct {
+		mu      sync.RWMutex
+		sub     *nats.Subscription
+		trigger *crd.MessageQueueTrigger
+		stopCh  chan struct{}
+	}
+
+	// natsCoreSubscription backs TriggerTypeRequest triggers: a plain core NATS queue
+	// subscription, so that a caller's nc.Request() inbox ends up on msg.Reply and we don't
+	// pay JetStream's ack/redelivery overhead for a pattern that's synchronous anyway.
+	natsCoreSubscription struct {
+		sub *nats.Subscription
 	}
 )
 
+func init() {
+	registerMessageQueue(MessageQueueTypeNats, makeNatsMessageQueue)
+}
+
 func makeNatsMessageQueue(routerUrl string, mqCfg MessageQueueConfig) (MessageQueue, error) {
-	conn, err := ns.Connect(natsClusterID, natsClientID, ns.NatsURL(mqCfg.Url))
+	n := &Nats{
+		routerUrl: routerUrl,
+		subs:      make(map[string]*natsSubscription),
+	}
+
+	reconnectWait := mqCfg.ReconnectWait
+	if reconnectWait <= 0 {
+		reconnectWait = natsDefaultReconnectWait
+	}
+	maxReconnects := mqCfg.MaxReconnects
+	if maxReconnects == 0 {
+		// The broker coming back is the common case for a mqtrigger pod that outlives it;
+		// retry indefinitely unless the caller asked for a bound.
+		maxReconnects = -1
+	}
+
+	conn, err := nats.Connect(mqCfg.Url,
+		nats.Name(natsClientID),
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(reconnectWait),
+		nats.CustomReconnectDelay(natsReconnectDelay(reconnectWait)),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Warningf("Lost connection to NATS server: %v", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Info("Reconnected to NATS server, resubscribing active triggers")
+			n.resubscribeAll()
+		}),
+		nats.ClosedHandler(func(_ *nats.Conn) {
+			log.Error("NATS connection closed, giving up reconnecting")
+		}),
+	)
 	if err != nil {
 		return nil, err
 	}
-	nats := Nats{
-		nsConn:    conn,
-		routerUrl: routerUrl,
+
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	return nats, nil
+
+	n.nsConn = conn
+	n.js = js
+	return n, nil
 }
 
-func (nats Nats) subscribe(trigger *crd.MessageQueueTrigger) (messageQueueSubscription, error) {
-	subj := trigger.Spec.Topic
+// natsReconnectDelay returns a CustomReconnectDelay func that backs off exponentially from
+// base, capped at natsMaxReconnectWait, instead of nats.go's default fixed delay.
+func natsReconnectDelay(base time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		if attempts > 6 {
+			attempts = 6
+		}
+		delay := base * (1 << uint(attempts))
+		if delay > natsMaxReconnectWait {
+			delay = natsMaxReconnectWait
+		}
+		return delay
+	}
+}
+
+// Health reports the Nats driver's current connection state, derived from the underlying
+// nats.Conn status.
+func (n *Nats) Health() ConnectionState {
+	switch n.nsConn.Status() {
+	case nats.CONNECTED:
+		return ConnectionConnected
+	case nats.RECONNECTING, nats.CONNECTING:
+		return ConnectionReconnecting
+	case nats.CLOSED:
+		return ConnectionClosed
+	default:
+		return ConnectionDisconnected
+	}
+}
+
+// resubscribeAll re-binds every tracked JetStream pull subscription after a reconnect. The
+// consumer's durable name is the trigger UID, so this binds back onto the same durable state
+// on the server rather than creating a new consumer.
+func (n *Nats) resubscribeAll() {
+	n.mu.RLock()
+	tracked := make([]*natsSubscription, 0, len(n.subs))
+	for _, s := range n.subs {
+		tracked = append(tracked, s)
+	}
+	n.mu.RUnlock()
+
+	for _, s := range tracked {
+		sub, err := n.js.PullSubscribe(
+			natsFilterSubject(s.trigger),
+			string(s.trigger.Metadata.UID),
+			nats.AckExplicit(),
+			nats.MaxDeliver(natsMaxDeliver(s.trigger)),
+			nats.BindStream(natsStreamName(s.trigger)),
+			natsDeliverPolicyOpt(s.trigger),
+		)
+		if err != nil {
+			log.Errorf("Failed to resubscribe trigger %v after reconnect: %v", s.trigger.Metadata.Name, err)
+			continue
+		}
+		s.mu.Lock()
+		s.sub = sub
+		s.mu.Unlock()
+	}
+}
+
+// natsStreamName returns the JetStream stream a trigger binds to: Spec.Stream if set,
+// otherwise the shared default stream.
+func natsStreamName(trigger *crd.MessageQueueTrigger) string {
+	if len(trigger.Spec.Stream) > 0 {
+		return trigger.Spec.Stream
+	}
+	return natsDefaultStreamName
+}
+
+// natsFilterSubject returns the subject the trigger's consumer filters on: Spec.FilterSubject
+// if set, otherwise the trigger's topic. JetStream (unlike nats-streaming) supports wildcard
+// subjects here, e.g. "orders.*".
+func natsFilterSubject(trigger *crd.MessageQueueTrigger) string {
+	if len(trigger.Spec.FilterSubject) > 0 {
+		return trigger.Spec.FilterSubject
+	}
+	return trigger.Spec.Topic
+}
+
+// natsDeliverPolicyOpt maps the CRD's DeliveryPolicy ("all", "new", "last",
+// "by_start_sequence") to the matching JetStream SubOpt. Defaults to DeliverAll, which
+// matches the at-least-once, replay-from-start behaviour nats-streaming durables had.
+func natsDeliverPolicyOpt(trigger *crd.MessageQueueTrigger) nats.SubOpt {
+	switch trigger.Spec.DeliveryPolicy {
+	case "new":
+		return nats.DeliverNew()
+	case "last":
+		return nats.DeliverLast()
+	case "by_start_sequence":
+		return nats.DeliverByStartSequence(trigger.Spec.StartSequence)
+	default:
+		return nats.DeliverAll()
+	}
+}
+
+// natsMaxDeliver clamps Spec.MaxRetries the same way invokeWithRetry does, so a trigger that
+// leaves it unset gets MaxDeliver(1) - one delivery attempt, no JetStream-level redelivery -
+// instead of MaxDeliver(0), which nats-server treats as unlimited redelivery.
+func natsMaxDeliver(trigger *crd.MessageQueueTrigger) int {
+	if trigger.Spec.MaxRetries <= 0 {
+		return 1
+	}
+	return trigger.Spec.MaxRetries
+}
+
+// ensureStream creates the trigger's stream if it doesn't already exist. Streams are shared
+// across triggers that set the same Spec.Stream (or leave it unset and share
+// natsDefaultStreamName), so once the stream exists this only needs to make sure its subject
+// set also covers this trigger's filter subject, adding it via UpdateStream if not.
+func (n *Nats) ensureStream(trigger *crd.MessageQueueTrigger) error {
+	streamName := natsStreamName(trigger)
+	filterSubject := natsFilterSubject(trigger)
+
+	info, err := n.js.StreamInfo(streamName)
+	if err != nil {
+		_, err := n.js.AddStream(&nats.StreamConfig{
+			Name:     streamName,
+			Subjects: []string{filterSubject},
+		})
+		return err
+	}
+
+	for _, subject := range info.Config.Subjects {
+		if subject == filterSubject {
+			return nil
+		}
+	}
+	info.Config.Subjects = append(info.Config.Subjects, filterSubject)
+	_, err = n.js.UpdateStream(&info.Config)
+	return err
+}
 
-	if !isTopicValidForNats(subj) {
-		return nil, errors.New(fmt.Sprintf("Not a valid topic: %s", trigger.Spec.Topic))
+func (n *Nats) subscribe(trigger *crd.MessageQueueTrigger) (messageQueueSubscription, error) {
+	if trigger.Spec.Type == TriggerTypeRequest {
+		return n.subscribeRequest(trigger)
 	}
 
-	opts := []ns.SubscriptionOption{
-		// Create a durable subscription to nats, so that triggers could retrieve last unack message.
-		// https://github.com/nats-io/go-nats-streaming#durable-subscriptions
-		ns.DurableName(string(trigger.Metadata.UID)),
+	if err := n.ensureStream(trigger); err != nil {
+		return nil, fmt.Errorf("failed to ensure stream for trigger %v: %w", trigger.Metadata.Name, err)
+	}
 
-		// Nats-streaming server is auto-ack mode by default. Since we want nats-streaming server to
-		// resend a message if the trigger does not ack it, we need to enable the manual ack mode, so that
-		// trigger could choose to ack message or simply drop it depend on the response of function pod.
-		ns.SetManualAckMode(),
+	sub, err := n.js.PullSubscribe(
+		natsFilterSubject(trigger),
+		string(trigger.Metadata.UID),
+		nats.AckExplicit(),
+		nats.MaxDeliver(natsMaxDeliver(trigger)),
+		nats.BindStream(natsStreamName(trigger)),
+		natsDeliverPolicyOpt(trigger),
+	)
+	if err != nil {
+		return nil, err
 	}
-	sub, err := nats.nsConn.Subscribe(subj, msgHandler(&nats, trigger), opts...)
+
+	natsSub := &natsSubscription{sub: sub, trigger: trigger, stopCh: make(chan struct{})}
+
+	n.mu.Lock()
+	n.subs[string(trigger.Metadata.UID)] = natsSub
+	n.mu.Unlock()
+
+	go n.pullLoop(natsSub)
+	return natsSub, nil
+}
+
+// subscribeRequest subscribes with a plain core NATS queue subscription instead of a
+// JetStream pull consumer, so that request/reply semantics (msg.Reply) work the way a client
+// calling nc.Request() expects.
+func (n *Nats) subscribeRequest(trigger *crd.MessageQueueTrigger) (messageQueueSubscription, error) {
+	sub, err := n.nsConn.QueueSubscribe(trigger.Spec.Topic, natsQueueGroup, msgHandler(n, trigger))
 	if err != nil {
 		return nil, err
 	}
-	return sub, nil
+	return &natsCoreSubscription{sub: sub}, nil
 }
 
-func (nats Nats) unsubscribe(subscription messageQueueSubscription) error {
-	return subscription.(ns.Subscription).Close()
+func (n *Nats) unsubscribe(subscription messageQueueSubscription) error {
+	if sub, ok := subscription.(*natsCoreSubscription); ok {
+		return sub.sub.Unsubscribe()
+	}
+	sub := subscription.(*natsSubscription)
+	close(sub.stopCh)
+
+	n.mu.Lock()
+	delete(n.subs, string(sub.trigger.Metadata.UID))
+	n.mu.Unlock()
+
+	sub.mu.RLock()
+	defer sub.mu.RUnlock()
+	return sub.sub.Unsubscribe()
 }
 
-func isTopicValidForNats(topic string) bool {
-	// nats-streaming does not support wildcard channel.
-	return nsUtil.IsChannelNameValid(topic, false)
+// pullLoop repeatedly fetches a batch of messages for a trigger's durable pull consumer and
+// hands each one to msgHandler, until unsubscribe closes sub.stopCh. sub.sub is re-read under
+// lock on every iteration since resubscribeAll swaps it after a reconnect.
+func (n *Nats) pullLoop(sub *natsSubscription) {
+	handle := msgHandler(n, sub.trigger)
+	for {
+		select {
+		case <-sub.stopCh:
+			return
+		default:
+		}
+
+		sub.mu.RLock()
+		jsSub := sub.sub
+		sub.mu.RUnlock()
+
+		msgs, err := jsSub.Fetch(natsPullBatchSize, nats.MaxWait(natsPullWait))
+		if err != nil {
+			if err != nats.ErrTimeout {
+				log.Warningf("Failed to fetch messages for trigger %v: %v", sub.trigger.Metadata.Name, err)
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			handle(msg)
+		}
+	}
 }
 
-func msgHandler(nats *Nats, trigger *crd.MessageQueueTrigger) func(*ns.Msg) {
-	return func(msg *ns.Msg) {
+// natsReplySubject returns where to send a synchronous reply for msg, or "" if the caller
+// didn't ask for one. Core NATS carries this in msg.Reply, but a JetStream-pulled message's
+// Reply field is JetStream's own internal ack-reply subject (the one msg.Metadata() parses),
+// not a caller-supplied inbox - so msg.Reply must only be trusted for the core-NATS
+// subscribeRequest path. Callers wanting a synchronous reply over JetStream instead set the
+// natsReplyHeader header to their inbox.
+func natsReplySubject(msg *nats.Msg, isRequestTrigger bool) string {
+	if isRequestTrigger && len(msg.Reply) > 0 {
+		return msg.Reply
+	}
+	if msg.Header != nil {
+		return msg.Header.Get(natsReplyHeader)
+	}
+	return ""
+}
+
+func msgHandler(n *Nats, trigger *crd.MessageQueueTrigger) func(*nats.Msg) {
+	return func(msg *nats.Msg) {
 
 		// Support other function ref types
 		if trigger.Spec.FunctionReference.Type != fission.FunctionReferenceTypeFunctionName {
@@ -100,7 +396,7 @@ func msgHandler(nats *Nats, trigger *crd.MessageQueueTrigger) func(*ns.Msg) {
 				trigger.Spec.FunctionReference.Type, trigger.Metadata.Name)
 		}
 
-		url := nats.routerUrl + "/" + strings.TrimPrefix(fission.UrlForFunction(trigger.Spec.FunctionReference.Name), "/")
+		url := n.routerUrl + "/" + strings.TrimPrefix(fission.UrlForFunction(trigger.Spec.FunctionReference.Name), "/")
 		log.Printf("Making HTTP request to %v", url)
 
 		headers := map[string]string{
@@ -110,86 +406,90 @@ func msgHandler(nats *Nats, trigger *crd.MessageQueueTrigger) func(*ns.Msg) {
 			"Content-Type":                   trigger.Spec.ContentType,
 		}
 
-		log.Info("Making sure the NATS message handler recognizes a valid error topic: ", trigger.Spec.ErrorTopic)
-		log.Info("And max retries value: ", trigger.Spec.MaxRetries)
-
-		// Create request
-		req, err := http.NewRequest("POST", url, bytes.NewReader(msg.Data))
-
-		if err != nil {
-			log.Errorf("Could not issue POST request with message to url %v", url)
-			return
-		}
-
-		for k, v := range headers {
-			req.Header.Add(k, v)
-		}
-
-		/*
-			Cases:
-				HTTP response is nil 							-> Retry if within max retries limit, else return
-				HTTP response body could not be read 			-> Return
-				HTTP request returned error or non-200 status	-> Publish error to error queue if specified and return
-				HTTP request did not return error and 200 status-> Ack the message and publish response to resp topic
-		*/
-
-		var resp *http.Response
-		// Number of retries is required to be between 1 and 5, inclusive
-		for attempt := 0; attempt < trigger.Spec.MaxRetries; attempt++ {
-			// Make the request
-			log.Warningf("Request : %v", req)
-			resp, err = http.DefaultClient.Do(req)
-			if resp == nil {
-				// Retry without referencing status code of nil response on the next line
-				continue
+		isRequestTrigger := trigger.Spec.Type == TriggerTypeRequest
+		result := invokeWithRetry(url, msg.Data, headers, trigger.Spec.MaxRetries)
+
+		// A caller doing a synchronous request/reply (nc.Request on core NATS, or the
+		// Nats-Reply header on JetStream) gets the function's response on its reply subject
+		// directly, with the HTTP status code carried in a header, regardless of whether
+		// ResponseTopic is also set.
+		if reply := natsReplySubject(msg, isRequestTrigger); len(reply) > 0 {
+			replyMsg := &nats.Msg{
+				Subject: reply,
+				Data:    result.body,
+				Header:  nats.Header{natsStatusCodeHeader: []string{strconv.Itoa(result.statusCode)}},
 			}
-			if err == nil && resp.StatusCode == 200 {
-				// Success, quit retries
-				break
+			if err := n.nsConn.PublishMsg(replyMsg); err != nil {
+				log.Warningf("Failed to publish reply to %s: %v", reply, err)
 			}
 		}
 
-		// Where should the following line go?
-		defer resp.Body.Close()
-
-		if resp == nil {
-			log.Warning("The response was undefined. Quit.")
-			return
-		}
-
-		body, bodyErr := ioutil.ReadAll(resp.Body)
-		if bodyErr != nil {
-			log.Warningf("Response body error: %v", string(body))
-			return
-		}
-
-		// Only the latest error response will be published to error topic
-		if err != nil || resp.StatusCode != 200 {
-			log.Errorf("Request to %v failed after %v retries, err : %v", url, trigger.Spec.MaxRetries, err)
-			log.Info("Attempting to publish error to error queue, if defined.")
-			log.Info("The response body is: %v", body)
+		if !result.success {
+			log.Errorf("Request to %v failed after %v attempt(s), err: %v", url, result.attempts, result.lastErr)
 
-			if len(trigger.Spec.ErrorTopic) > 0 {
-				publishErr := nats.nsConn.Publish(trigger.Spec.ErrorTopic, body)
-				if publishErr != nil {
-					log.Error("Failed to publish error to error topic: %v", err)
+			if topic := deadLetterTopic(trigger); len(topic) > 0 {
+				if err := n.publish(topic, result.body, deadLetterHeaders(result)); err != nil {
+					log.Errorf("Failed to publish to dead letter/error topic %s: %v", topic, err)
+				}
+			} else {
+				log.Warningf("No DeadLetterTopic or ErrorTopic set for trigger %v, dropping message after %v attempt(s)",
+					trigger.Metadata.Name, result.attempts)
+			}
+			// invokeWithRetry already exhausted trigger.Spec.MaxRetries HTTP attempts with its
+			// own backoff, so this delivery is done: Term (not Nak) so JetStream's MaxDeliver
+			// redelivery doesn't run the whole retry loop again on top of it. MaxDeliver stays
+			// as a safety net for the handler crashing before reaching this point. A
+			// TriggerTypeRequest message came off a plain core-NATS subscription, which has
+			// nothing to ack/term.
+			if !isRequestTrigger {
+				if termErr := msg.Term(); termErr != nil {
+					log.Warningf("Failed to terminate message: %v", termErr)
 				}
 			}
 			return
 		}
 
-		// trigger acks message only if a request done successfully
-		err = msg.Ack()
-		if err != nil {
-			log.Warningf("Failed to ack message: %v", err)
+		// trigger acks message only if a request done successfully. AckSync blocks until the
+		// server confirms the ack, so a crash right after doesn't cause a silent redelivery
+		// that duplicates the response we're about to publish below. A TriggerTypeRequest
+		// message came off a plain core-NATS subscription, which has nothing to ack.
+		if !isRequestTrigger {
+			if err := msg.AckSync(); err != nil {
+				log.Warningf("Failed to ack message: %v", err)
+			}
 		}
 
 		if len(trigger.Spec.ResponseTopic) > 0 {
-			err = nats.nsConn.Publish(trigger.Spec.ResponseTopic, body)
-			if err != nil {
+			// Dedup the response on the trigger UID + stream sequence of the triggering message,
+			// so that a redelivery (e.g. after a lost ack) doesn't publish twice. A core-NATS
+			// message has no stream sequence and is never redelivered, so its response is
+			// published without a Nats-Msg-Id.
+			var respHeaders map[string]string
+			if meta, metaErr := msg.Metadata(); metaErr == nil {
+				respHeaders = map[string]string{"Nats-Msg-Id": fmt.Sprintf("%s-%d", trigger.Metadata.UID, meta.Sequence.Stream)}
+			}
+			if err := n.publish(trigger.Spec.ResponseTopic, result.body, respHeaders); err != nil {
 				log.Warningf("Failed to publish message to topic %s: %v", trigger.Spec.ResponseTopic, err)
 			}
 		}
 	}
+}
 
+// publish sends body on subject. A non-empty headers map is set via JetStream's PublishMsg, so
+// e.g. a Nats-Msg-Id header triggers the server's publish-side dedup window.
+func (n *Nats) publish(subject string, body []byte, headers map[string]string) error {
+	if len(headers) == 0 {
+		return n.nsConn.Publish(subject, body)
+	}
+	h := nats.Header{}
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	msg := &nats.Msg{
+		Subject: subject,
+		Data:    body,
+		Header:  h,
+	}
+	_, err := n.js.PublishMsg(msg)
+	return err
 }
@@ -0,0 +1,179 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package messageQueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/crd"
+)
+
+// freePort asks the OS for a free TCP port and hands it back so the same address can be reused
+// across an embedded nats-server being shut down and started again.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startEmbeddedNatsServer starts a JetStream-enabled nats-server on the given port, backed by
+// storeDir, so that stream/consumer state persists across the server being restarted on the
+// same port in the same test.
+func startEmbeddedNatsServer(t *testing.T, storeDir string, port int) *natsserver.Server {
+	t.Helper()
+	s, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  storeDir,
+	})
+	if err != nil {
+		t.Fatalf("failed to create embedded nats-server: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("embedded nats-server never became ready")
+	}
+	return s
+}
+
+// TestNatsDurableSubscriptionSurvivesServerRestart kills and restarts the embedded nats-server
+// mid-stream and asserts that a durable JetStream subscription doesn't lose messages published
+// either side of the restart: the reconnect handler's resubscribeAll must rebind the pull
+// consumer rather than leave pullLoop stuck on a dead subscription.
+func TestNatsDurableSubscriptionSurvivesServerRestart(t *testing.T) {
+	storeDir, err := ioutil.TempDir("", "fission-nats-test")
+	if err != nil {
+		t.Fatalf("failed to create JetStream store dir: %v", err)
+	}
+	defer os.RemoveAll(storeDir)
+
+	port := freePort(t)
+	natsURL := fmt.Sprintf("nats://127.0.0.1:%d", port)
+	s := startEmbeddedNatsServer(t, storeDir, port)
+
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received[string(body)] = true
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer router.Close()
+
+	mq, err := makeNatsMessageQueue(router.URL, MessageQueueConfig{
+		Url:           natsURL,
+		MaxReconnects: -1,
+		ReconnectWait: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed to connect to embedded nats-server: %v", err)
+	}
+	n := mq.(*Nats)
+	defer n.nsConn.Close()
+
+	trigger := &crd.MessageQueueTrigger{
+		Metadata: metav1.ObjectMeta{Name: "durable-trigger", UID: "durable-trigger-uid"},
+		Spec: fission.MessageQueueTriggerSpec{
+			Topic:      "restart.test",
+			MaxRetries: 1,
+			FunctionReference: fission.FunctionReference{
+				Type: fission.FunctionReferenceTypeFunctionName,
+				Name: "echo",
+			},
+		},
+	}
+
+	sub, err := n.subscribe(trigger)
+	if err != nil {
+		t.Fatalf("failed to subscribe: %v", err)
+	}
+	defer n.unsubscribe(sub)
+
+	const beforeCount = 5
+	for i := 0; i < beforeCount; i++ {
+		publishTestMessage(t, n, trigger, fmt.Sprintf("before-%d", i))
+	}
+	waitForReceivedCount(t, &mu, received, beforeCount, 5*time.Second)
+
+	// Kill the server and bring it back up on the same port/store dir, simulating a broker
+	// outage mid-stream.
+	s.Shutdown()
+	s = startEmbeddedNatsServer(t, storeDir, port)
+	defer s.Shutdown()
+	waitForHealth(t, n, ConnectionConnected, 5*time.Second)
+
+	const afterCount = 5
+	for i := 0; i < afterCount; i++ {
+		publishTestMessage(t, n, trigger, fmt.Sprintf("after-%d", i))
+	}
+	waitForReceivedCount(t, &mu, received, beforeCount+afterCount, 5*time.Second)
+}
+
+func publishTestMessage(t *testing.T, n *Nats, trigger *crd.MessageQueueTrigger, body string) {
+	t.Helper()
+	if _, err := n.js.Publish(trigger.Spec.Topic, []byte(body)); err != nil {
+		t.Fatalf("failed to publish %q: %v", body, err)
+	}
+}
+
+func waitForReceivedCount(t *testing.T, mu *sync.Mutex, received map[string]bool, want int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		got := len(received)
+		mu.Unlock()
+		if got >= want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	t.Fatalf("timed out waiting for %d messages, got %d: %v", want, len(received), received)
+}
+
+func waitForHealth(t *testing.T, n *Nats, want ConnectionState, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if n.Health() == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for connection state %v, got %v", want, n.Health())
+}
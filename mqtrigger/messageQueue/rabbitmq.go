@@ -0,0 +1,315 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package messageQueue
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/fission/fission"
+	"github.com/fission/fission/crd"
+)
+
+const (
+	// rabbitMQDefaultExchangeType is used when MessageQueueConfig.ExchangeType is left empty.
+	rabbitMQDefaultExchangeType = "topic"
+
+	// rabbitMQDefaultPrefetchCount bounds in-flight unacked messages per consumer when
+	// MessageQueueConfig.PrefetchCount is left at its zero value.
+	rabbitMQDefaultPrefetchCount = 1
+)
+
+type (
+	RabbitMQ struct {
+		conn          *amqp.Connection
+		routerUrl     string
+		exchangeType  string
+		prefetchCount int
+	}
+
+	// rabbitMQSubscription is the handle returned by RabbitMQ.subscribe; unsubscribe uses it
+	// to cancel the consumer and close its channel.
+	rabbitMQSubscription struct {
+		channel     *amqp.Channel
+		consumerTag string
+	}
+)
+
+func init() {
+	registerMessageQueue(MessageQueueTypeRabbitMQ, makeRabbitMQMessageQueue)
+}
+
+func makeRabbitMQMessageQueue(routerUrl string, mqCfg MessageQueueConfig) (MessageQueue, error) {
+	var (
+		conn *amqp.Connection
+		err  error
+	)
+
+	if len(mqCfg.Secrets) > 0 {
+		tlsConfig, tlsErr := buildRabbitMQTLSConfig(mqCfg.Secrets)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		conn, err = amqp.DialTLS(mqCfg.Url, tlsConfig)
+	} else {
+		conn, err = amqp.Dial(mqCfg.Url)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	exchangeType := mqCfg.ExchangeType
+	if len(exchangeType) == 0 {
+		exchangeType = rabbitMQDefaultExchangeType
+	}
+
+	prefetchCount := mqCfg.PrefetchCount
+	if prefetchCount <= 0 {
+		prefetchCount = rabbitMQDefaultPrefetchCount
+	}
+
+	return &RabbitMQ{
+		conn:          conn,
+		routerUrl:     routerUrl,
+		exchangeType:  exchangeType,
+		prefetchCount: prefetchCount,
+	}, nil
+}
+
+// buildRabbitMQTLSConfig loads a CA cert, client cert and client key (cacert.pem, cert.pem,
+// key.pem) from secretsDir, which is expected to be a Kubernetes secret mounted as a volume.
+func buildRabbitMQTLSConfig(secretsDir string) (*tls.Config, error) {
+	caCert, err := ioutil.ReadFile(filepath.Join(secretsDir, "cacert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to parse CA cert in %s", secretsDir)
+	}
+
+	cert, err := tls.LoadX509KeyPair(
+		filepath.Join(secretsDir, "cert.pem"),
+		filepath.Join(secretsDir, "key.pem"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		RootCAs:      caCertPool,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// rabbitMQExchangeName derives the exchange a topic is published/consumed on. Every trigger
+// topic gets its own exchange, with the topic itself used as the routing key, so that
+// Topic/ResponseTopic/ErrorTopic can be routed independently while still sharing a broker.
+func rabbitMQExchangeName(topic string) string {
+	return fmt.Sprintf("fission-%s", topic)
+}
+
+func (r *RabbitMQ) declareExchange(ch *amqp.Channel, topic string) error {
+	return ch.ExchangeDeclare(
+		rabbitMQExchangeName(topic), // name
+		r.exchangeType,              // type
+		true,                        // durable
+		false,                       // auto-deleted
+		false,                       // internal
+		false,                       // no-wait
+		nil,                         // arguments
+	)
+}
+
+func (r *RabbitMQ) publish(topic string, body []byte, headers amqp.Table) error {
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := r.declareExchange(ch, topic); err != nil {
+		return err
+	}
+
+	return ch.Publish(
+		rabbitMQExchangeName(topic), // exchange
+		topic,                       // routing key
+		false,                       // mandatory
+		false,                       // immediate
+		amqp.Publishing{
+			ContentType: "application/octet-stream",
+			Body:        body,
+			Headers:     headers,
+		},
+	)
+}
+
+func (r *RabbitMQ) subscribe(trigger *crd.MessageQueueTrigger) (messageQueueSubscription, error) {
+	topic := trigger.Spec.Topic
+	queueName := string(trigger.Metadata.UID)
+
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.declareExchange(ch, topic); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	// Durable, per-trigger queue: messages survive a broker restart and, combined with
+	// manual ack below, are redelivered if the trigger never acks them.
+	q, err := ch.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	if err := ch.QueueBind(q.Name, topic, rabbitMQExchangeName(topic), false, nil); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	if err := ch.Qos(r.prefetchCount, 0, false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	consumerTag := fmt.Sprintf("fission-%s", queueName)
+	deliveries, err := ch.Consume(
+		q.Name,      // queue
+		consumerTag, // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // arguments
+	)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	go r.consume(trigger, deliveries)
+
+	return &rabbitMQSubscription{channel: ch, consumerTag: consumerTag}, nil
+}
+
+// Health reports whether the driver's connection to the broker is still open. RabbitMQ's
+// client library doesn't expose a reconnecting state, so this only distinguishes connected
+// from closed.
+func (r *RabbitMQ) Health() ConnectionState {
+	if r.conn.IsClosed() {
+		return ConnectionClosed
+	}
+	return ConnectionConnected
+}
+
+func (r *RabbitMQ) unsubscribe(subscription messageQueueSubscription) error {
+	sub := subscription.(*rabbitMQSubscription)
+	if err := sub.channel.Cancel(sub.consumerTag, false); err != nil {
+		return err
+	}
+	return sub.channel.Close()
+}
+
+func (r *RabbitMQ) consume(trigger *crd.MessageQueueTrigger, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		r.handleDelivery(trigger, d)
+	}
+}
+
+func (r *RabbitMQ) handleDelivery(trigger *crd.MessageQueueTrigger, d amqp.Delivery) {
+	// Support other function ref types
+	if trigger.Spec.FunctionReference.Type != fission.FunctionReferenceTypeFunctionName {
+		log.Fatalf("Unsupported function reference type (%v) for trigger %v",
+			trigger.Spec.FunctionReference.Type, trigger.Metadata.Name)
+	}
+
+	url := r.routerUrl + "/" + strings.TrimPrefix(fission.UrlForFunction(trigger.Spec.FunctionReference.Name), "/")
+	log.Printf("Making HTTP request to %v", url)
+
+	headers := map[string]string{
+		"X-Fission-MQTrigger-Topic":      trigger.Spec.Topic,
+		"X-Fission-MQTrigger-RespTopic":  trigger.Spec.ResponseTopic,
+		"X-Fission-MQTrigger-ErrorTopic": trigger.Spec.ErrorTopic,
+		"Content-Type":                   trigger.Spec.ContentType,
+	}
+
+	// Forward any X-Fission-MQTrigger-* headers the publisher attached to the AMQP message.
+	for k, v := range d.Headers {
+		if strings.HasPrefix(k, "X-Fission-MQTrigger-") {
+			headers[k] = fmt.Sprintf("%v", v)
+		}
+	}
+
+	result := invokeWithRetry(url, d.Body, headers, trigger.Spec.MaxRetries)
+
+	if !result.success {
+		log.Errorf("Request to %v failed after %v attempt(s), err: %v", url, result.attempts, result.lastErr)
+
+		topic := deadLetterTopic(trigger)
+		if len(topic) > 0 {
+			amqpHeaders := amqp.Table{"X-Fission-MQTrigger-Topic": trigger.Spec.Topic}
+			for k, v := range deadLetterHeaders(result) {
+				amqpHeaders[k] = v
+			}
+			if publishErr := r.publish(topic, result.body, amqpHeaders); publishErr != nil {
+				log.Errorf("Failed to publish to dead letter/error topic %s: %v", topic, publishErr)
+			}
+		} else {
+			log.Warningf("No DeadLetterTopic or ErrorTopic set for trigger %v, dropping message after %v attempt(s)",
+				trigger.Metadata.Name, result.attempts)
+		}
+		// invokeWithRetry already exhausted trigger.Spec.MaxRetries, so this delivery is done
+		// either way: don't requeue, matching the NATS driver's msg.Term() in the same
+		// no-dead-letter-topic case instead of looping it through redelivery forever.
+		if nackErr := d.Nack(false, false); nackErr != nil {
+			log.Warningf("Failed to nack message: %v", nackErr)
+		}
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		log.Warningf("Failed to ack message: %v", err)
+	}
+
+	if len(trigger.Spec.ResponseTopic) > 0 {
+		if err := r.publish(trigger.Spec.ResponseTopic, result.body, amqp.Table{
+			"X-Fission-MQTrigger-Topic": trigger.Spec.Topic,
+		}); err != nil {
+			log.Warningf("Failed to publish message to topic %s: %v", trigger.Spec.ResponseTopic, err)
+		}
+	}
+}
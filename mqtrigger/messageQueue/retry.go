@@ -0,0 +1,149 @@
+/*
+Copyright 2016 The Fission Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package messageQueue
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/fission/fission/crd"
+)
+
+const (
+	// retryBaseDelay and retryMaxDelay bound the exponential backoff between HTTP attempts.
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+
+	// Dead-letter/error headers describing why a message was given up on.
+	headerAttempts       = "X-Fission-MQTrigger-Attempts"
+	headerLastStatusCode = "X-Fission-MQTrigger-LastStatusCode"
+	headerLastError      = "X-Fission-MQTrigger-LastError"
+)
+
+// httpResult is what's left after invokeWithRetry gives up: either a successful (200) response
+// body, or the attempt count and last failure to report via the dead-letter/error topic.
+type httpResult struct {
+	body       []byte
+	statusCode int
+	attempts   int
+	lastErr    error
+	success    bool
+}
+
+// invokeWithRetry POSTs body to url once per attempt, up to maxRetries times, rebuilding the
+// request from body each time (a *http.Request can't be replayed once its body is drained).
+// Network errors and 5xx responses are retried with exponential backoff and jitter; 4xx
+// responses are treated as terminal, since retrying a client error just wastes attempts.
+func invokeWithRetry(url string, body []byte, headers map[string]string, maxRetries int) httpResult {
+	if maxRetries <= 0 {
+		maxRetries = 1
+	}
+
+	var result httpResult
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		result.attempts = attempt
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			result.lastErr = fmt.Errorf("failed to build request: %w", err)
+			return result
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			result.lastErr = err
+			// No response to read a status from this attempt; clear any status left over from
+			// an earlier attempt so a network error doesn't get reported under a stale code.
+			result.statusCode = 0
+			if attempt < maxRetries {
+				time.Sleep(retryBackoff(attempt))
+			}
+			continue
+		}
+
+		respBody, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		result.statusCode = resp.StatusCode
+
+		if readErr != nil {
+			result.lastErr = fmt.Errorf("failed to read response body: %w", readErr)
+			return result
+		}
+		result.body = respBody
+
+		if resp.StatusCode == http.StatusOK {
+			result.lastErr = nil
+			result.success = true
+			return result
+		}
+
+		result.lastErr = fmt.Errorf("function returned status %d", resp.StatusCode)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			// Terminal: the function rejected the message, retrying the same body won't help.
+			return result
+		}
+		if attempt < maxRetries {
+			time.Sleep(retryBackoff(attempt))
+		}
+	}
+	return result
+}
+
+// retryBackoff returns an exponential delay from retryBaseDelay, capped at retryMaxDelay, with
+// up to 50% jitter so that many triggers failing at once don't retry in lockstep.
+func retryBackoff(attempt int) time.Duration {
+	if attempt > 10 {
+		attempt = 10
+	}
+	delay := retryBaseDelay * time.Duration(1<<uint(attempt-1))
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay/2 + jitter
+}
+
+// deadLetterHeaders describes why a message is being given up on, for the consumer of the
+// dead-letter/error topic to act on without having to parse the body.
+func deadLetterHeaders(result httpResult) map[string]string {
+	lastErr := ""
+	if result.lastErr != nil {
+		lastErr = result.lastErr.Error()
+	}
+	return map[string]string{
+		headerAttempts:       fmt.Sprintf("%d", result.attempts),
+		headerLastStatusCode: fmt.Sprintf("%d", result.statusCode),
+		headerLastError:      lastErr,
+	}
+}
+
+// deadLetterTopic returns where to forward a message that's exhausted its retries:
+// Spec.DeadLetterTopic if set, falling back to Spec.ErrorTopic so existing triggers that only
+// set ErrorTopic keep working unchanged.
+func deadLetterTopic(trigger *crd.MessageQueueTrigger) string {
+	if len(trigger.Spec.DeadLetterTopic) > 0 {
+		return trigger.Spec.DeadLetterTopic
+	}
+	return trigger.Spec.ErrorTopic
+}